@@ -0,0 +1,157 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// TLS certificate hot-reload and SNI-based certificate selection.
+
+package diam
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// CertProvider supplies TLS certificates to a Server, letting operators
+// rotate certificates or select one per SNI without restarting the
+// listener.
+type CertProvider interface {
+	// GetCertificate returns the certificate to serve for hello,
+	// following the same contract as tls.Config.GetCertificate.
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// Watch returns a channel that receives a value whenever the
+	// certificate served by GetCertificate changes.
+	Watch() <-chan struct{}
+}
+
+// FileCertProvider is a CertProvider backed by a certificate and key on
+// disk. It reloads both files whenever either changes.
+type FileCertProvider struct {
+	certFile, keyFile string
+	cert              atomic.Value // holds *tls.Certificate
+	watchc            chan struct{}
+	watcher           *fsnotify.Watcher
+}
+
+// NewFileCertProvider loads the certificate and key at certFile and
+// keyFile and starts watching both for changes. certFile may contain a
+// full PEM chain, in which case every intermediate certificate in it is
+// served alongside the leaf.
+//
+// Rotation tools (k8s secret mounts, certbot, acme.sh) typically replace
+// a cert file by atomic rename or symlink swap rather than writing to
+// it, which detaches an inotify watch registered on the file itself and
+// silently stops future reloads. To survive that, NewFileCertProvider
+// watches the parent directory (or directories) of certFile and keyFile
+// instead of the files, and filters events down to those two names.
+func NewFileCertProvider(certFile, keyFile string) (*FileCertProvider, error) {
+	p := &FileCertProvider{
+		certFile: certFile,
+		keyFile:  keyFile,
+		watchc:   make(chan struct{}, 1),
+	}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{
+		filepath.Dir(certFile): true,
+		filepath.Dir(keyFile):  true,
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	p.watcher = w
+	go p.watchLoop()
+	return p, nil
+}
+
+// watchLoop reloads the certificate whenever fsnotify reports a change
+// to certFile or keyFile within a watched directory, re-adding the
+// directory watch on each write, create or rename event for those two
+// names so a rename of the directory entry itself (not just the file)
+// doesn't detach it either.
+func (p *FileCertProvider) watchLoop() {
+	for {
+		select {
+		case ev, ok := <-p.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			name := filepath.Clean(ev.Name)
+			if name != filepath.Clean(p.certFile) && name != filepath.Clean(p.keyFile) {
+				continue
+			}
+			// Re-add the directory in case the event was itself a
+			// rename/remove of a watched entry; fsnotify drops the
+			// watch on the old inode but the directory watch above
+			// already covers the new one, so this is a no-op on
+			// most platforms and a safety net on the rest.
+			p.watcher.Add(filepath.Dir(ev.Name))
+			if err := p.reload(); err != nil {
+				continue
+			}
+			select {
+			case p.watchc <- struct{}{}:
+			default:
+			}
+		case _, ok := <-p.watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// reload parses the PEM chain in certFile and the key in keyFile and
+// atomically swaps the certificate GetCertificate serves. certFile may
+// contain intermediate CA certificates after the leaf; tls.X509KeyPair
+// already walks every "CERTIFICATE" PEM block into the returned
+// tls.Certificate, so those intermediates are included for free.
+func (p *FileCertProvider) reload() error {
+	certPEM, err := ioutil.ReadFile(p.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(p.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	p.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate implements CertProvider.
+func (p *FileCertProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return p.cert.Load().(*tls.Certificate), nil
+}
+
+// Watch implements CertProvider.
+func (p *FileCertProvider) Watch() <-chan struct{} {
+	return p.watchc
+}
+
+// Close stops watching the certificate and key files.
+func (p *FileCertProvider) Close() error {
+	if p.watcher == nil {
+		return nil
+	}
+	return p.watcher.Close()
+}
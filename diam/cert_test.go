@@ -0,0 +1,112 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package diam
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateTestCert returns a PEM-encoded self-signed certificate and key
+// for cn, good for the test's duration.
+func generateTestCert(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+// TestFileCertProviderReloadsOnAtomicRename is a regression test for the
+// directory-watch fix: rotation tools (k8s secret mounts, certbot,
+// acme.sh) replace a cert by writing new files alongside the old ones
+// and renaming them into place, which detaches an inotify watch
+// registered on the old file. NewFileCertProvider must watch the parent
+// directory instead, so this rotation style is still picked up.
+func TestFileCertProviderReloadsOnAtomicRename(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+
+	certPEM1, keyPEM1 := generateTestCert(t, "first")
+	if err := ioutil.WriteFile(certPath, certPEM1, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM1, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewFileCertProvider(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	cert1, err := p.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM2, keyPEM2 := generateTestCert(t, "second")
+	tmpCert := certPath + ".tmp"
+	tmpKey := keyPath + ".tmp"
+	if err := ioutil.WriteFile(tmpCert, certPEM2, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tmpKey, keyPEM2, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Atomic-rename rotation, not a write to the existing files.
+	if err := os.Rename(tmpCert, certPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpKey, keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-p.Watch():
+	case <-time.After(5 * time.Second):
+		t.Fatal("FileCertProvider did not observe the renamed cert/key")
+	}
+
+	cert2, err := p.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert2.Certificate[0]) == string(cert1.Certificate[0]) {
+		t.Fatal("GetCertificate still returns the pre-rotation certificate")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Diameter client connection helpers.
+
+package diam
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/fiorix/go-diameter/diam/dict"
+)
+
+// Dial establishes a diameter connection to addr over network, which may
+// be "tcp" (the default when network is empty), "sctp", "sctp4" or
+// "sctp6". dp selects the dictionary used to parse messages received on
+// the connection; dict.Default is used when dp is nil.
+//
+// The returned Conn is used to write the initial CER. Messages the peer
+// sends back, such as the CEA and later DWR/DPR, are read in a
+// background goroutine and dispatched to handler exactly like a server
+// connection; handler is typically nil, in which case DefaultServeMux is
+// used.
+func Dial(network, addr string, handler Handler, dp *dict.Parser) (Conn, error) {
+	rwc, err := dialNetwork(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClientConn(rwc, handler, dp)
+}
+
+// DialTLS acts like Dial but establishes the connection over TLS, using
+// config or an empty tls.Config when config is nil.
+func DialTLS(network, addr string, config *tls.Config, handler Handler, dp *dict.Parser) (Conn, error) {
+	rwc, err := dialNetwork(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return newClientConn(tls.Client(rwc, config), handler, dp)
+}
+
+// dialNetwork dials addr over network, routing the SCTP variants to the
+// platform-specific sctpDial.
+func dialNetwork(network, addr string) (net.Conn, error) {
+	switch {
+	case network == "" || network == NetworkTCP:
+		return net.Dial("tcp", addr)
+	case isSCTPNetwork(network):
+		return sctpDial(network, addr)
+	default:
+		return net.Dial(network, addr)
+	}
+}
+
+// newClientConn wraps rwc in the same conn type the server side uses, so
+// a dialed connection gets identical message framing, SCTP stream/PPID
+// access, TLS state reporting and, via conn.serve, the same read and
+// dispatch loop a server connection gets.
+//
+// If rwc is a *tls.Conn, as DialTLS hands it, the handshake is run here
+// synchronously so a failure is returned to the caller directly instead
+// of surfacing only as a silent close once conn.serve's goroutine gets
+// around to it.
+func newClientConn(rwc net.Conn, handler Handler, dp *dict.Parser) (Conn, error) {
+	if tlsConn, ok := rwc.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			rwc.Close()
+			return nil, err
+		}
+	}
+	srv := &Server{Handler: handler, Dict: dp}
+	c, err := srv.newConn(rwc)
+	if err != nil {
+		return nil, err
+	}
+	go c.serve()
+	return c.writer, nil
+}
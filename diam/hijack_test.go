@@ -0,0 +1,48 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package diam
+
+import (
+	"net"
+	"testing"
+)
+
+// TestHijackUntracksConnImmediately is a regression test for a race
+// found in review: conn.serve only noticed a hijack and called
+// setState(StateHijacked) after ServeDIAM returned, so a Shutdown
+// landing between Hijack returning and ServeDIAM returning could still
+// see the conn in srv.conns and have forceStop set a deadline on the
+// net.Conn the caller now owns. Hijack must remove the conn from
+// srv.conns itself, synchronously, not leave it to be noticed later.
+func TestHijackUntracksConnImmediately(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	srv := &Server{}
+	c, err := srv.newConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.setState(StateNew) // what conn.serve does before its read loop
+
+	if n := srv.numConns(); n != 1 {
+		t.Fatalf("numConns() = %d, want 1 after setState(StateNew)", n)
+	}
+
+	rwc, _, err := c.writer.Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+
+	if n := srv.numConns(); n != 0 {
+		t.Fatalf("numConns() = %d, want 0 immediately after Hijack returns, "+
+			"before conn.serve's defer notices isHijacked", n)
+	}
+
+	if _, _, err := c.writer.Hijack(); err == nil {
+		t.Fatal("second Hijack call succeeded, want an error")
+	}
+}
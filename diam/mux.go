@@ -0,0 +1,185 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Byte-header connection multiplexing, so a diameter Server can share a
+// single listening port with other protocols.
+
+package diam
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// errMuxListenerClosed is returned by a muxListener's Accept once its
+// Close method has been called.
+var errMuxListenerClosed = errors.New("diam: mux listener closed")
+
+// defaultPeekTimeout is the deadline ConnMux.dispatch sets before
+// peeking at a connection's first byte, used when ConnMux.PeekTimeout
+// is zero. It bounds how long a connection that never sends a byte can
+// park a goroutine and a file descriptor on the mux.
+const defaultPeekTimeout = 5 * time.Second
+
+// ConnMux multiplexes a single net.Listener across several protocols by
+// peeking at the first byte of every accepted connection, without
+// consuming it, and dispatching the connection to the sub-listener
+// registered for that byte. Diameter messages always start with version
+// byte 0x01 (see ReadHeader), so a diameter Server can share its port
+// with sidecar protocols such as health checks or a raw TLS handshake
+// (0x16).
+type ConnMux struct {
+	ln net.Listener
+
+	// PeekTimeout bounds how long dispatch waits for a connection's
+	// first byte before giving up and closing it. Zero means
+	// defaultPeekTimeout.
+	PeekTimeout time.Duration
+
+	mu   sync.Mutex
+	subs map[byte]*muxListener
+}
+
+// NewConnMux wraps ln so that Listen can register sub-listeners keyed by
+// the first byte of each connection ln accepts.
+func NewConnMux(ln net.Listener) *ConnMux {
+	return &ConnMux{
+		ln:   ln,
+		subs: make(map[byte]*muxListener),
+	}
+}
+
+// Listen returns a net.Listener that yields connections accepted by the
+// underlying listener whose first byte equals b. Listen panics if b is
+// already registered.
+func (m *ConnMux) Listen(b byte) net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subs[b]; ok {
+		panic("diam: ConnMux.Listen called twice for the same byte")
+	}
+	l := &muxListener{
+		addr:   m.ln.Addr(),
+		connc:  make(chan net.Conn),
+		closec: make(chan struct{}),
+	}
+	m.subs[b] = l
+	return l
+}
+
+// Serve accepts connections from the underlying listener and dispatches
+// each to the sub-listener registered for its first byte, closing
+// connections whose first byte has no registered sub-listener. Serve
+// blocks until the underlying listener is closed.
+func (m *ConnMux) Serve() error {
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		c, err := m.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("DIAM: ConnMux accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			m.closeSubs()
+			return err
+		}
+		tempDelay = 0
+		go m.dispatch(c)
+	}
+}
+
+// closeSubs closes every registered sub-listener so their Accept calls
+// return errMuxListenerClosed instead of blocking forever once the
+// underlying listener has died and Serve has nothing left to dispatch.
+func (m *ConnMux) closeSubs() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.subs {
+		l.Close()
+	}
+}
+
+func (m *ConnMux) dispatch(c net.Conn) {
+	timeout := m.PeekTimeout
+	if timeout == 0 {
+		timeout = defaultPeekTimeout
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	br := bufio.NewReader(c)
+	b, err := br.Peek(1)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	m.mu.Lock()
+	l, ok := m.subs[b[0]]
+	m.mu.Unlock()
+	if !ok {
+		c.Close()
+		return
+	}
+	select {
+	case l.connc <- &peekedConn{Conn: c, r: br}:
+	case <-l.closec:
+		c.Close()
+	}
+}
+
+// muxListener is the net.Listener returned by ConnMux.Listen.
+type muxListener struct {
+	addr   net.Addr
+	connc  chan net.Conn
+	closec chan struct{}
+	once   sync.Once
+}
+
+// Accept implements net.Listener.
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connc:
+		return c, nil
+	case <-l.closec:
+		return nil, errMuxListenerClosed
+	}
+}
+
+// Close implements net.Listener. It only stops this sub-listener; the
+// underlying ConnMux and its other sub-listeners are unaffected.
+func (l *muxListener) Close() error {
+	l.once.Do(func() { close(l.closec) })
+	return nil
+}
+
+// Addr implements net.Listener, returning the address of the underlying
+// listener shared by the ConnMux.
+func (l *muxListener) Addr() net.Addr {
+	return l.addr
+}
+
+// peekedConn is a net.Conn whose Read first drains the bytes ConnMux
+// already buffered while peeking at the connection's first byte, so
+// protocol parsers such as ReadHeader still see the whole byte stream.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read implements net.Conn.
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
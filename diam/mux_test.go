@@ -0,0 +1,53 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package diam
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestConnMuxServeClosesSubsOnListenerDeath is a regression test for a
+// hang found in review: a sub-listener's Accept would block forever if
+// the underlying listener died (or was closed directly, bypassing
+// Server.Shutdown) instead of being unblocked by Serve returning.
+func TestConnMuxServeClosesSubsOnListenerDeath(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewConnMux(ln)
+	sub := m.Listen('A')
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- m.Serve() }()
+
+	// Close the underlying listener directly, as a caller that never
+	// wired ln through a diam.Server would.
+	ln.Close()
+
+	select {
+	case <-serveErr:
+	case <-time.After(time.Second):
+		t.Fatal("ConnMux.Serve did not return after its listener closed")
+	}
+
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := sub.Accept()
+		acceptErr <- err
+	}()
+
+	select {
+	case err := <-acceptErr:
+		if err != errMuxListenerClosed {
+			t.Fatalf("sub.Accept returned %v, want errMuxListenerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sub-listener Accept did not unblock after Serve returned")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// SCTP transport support, shared between platforms. The actual listening
+// and dialing is implemented per-platform in sctp_linux.go and
+// sctp_other.go, since SCTP requires kernel support that isn't available
+// everywhere Go runs.
+
+package diam
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Network values accepted by Server.Network and Dial/DialTLS. NetworkSCTP
+// lets the kernel pick the IP family, while NetworkSCTP4 and NetworkSCTP6
+// restrict it, mirroring the "tcp"/"tcp4"/"tcp6" convention of net.Dial.
+const (
+	NetworkTCP   = "tcp"
+	NetworkSCTP  = "sctp"
+	NetworkSCTP4 = "sctp4"
+	NetworkSCTP6 = "sctp6"
+)
+
+// sctpPPID is the Payload Protocol Identifier reserved for Diameter over
+// SCTP (RFC 6733 section 2.1.1).
+const sctpPPID uint32 = 46
+
+// SCTPInfo describes the SCTP stream and payload protocol identifier a
+// message was sent or received on. Conn.SCTPInfo reports ok=false for
+// connections that are not using SCTP.
+type SCTPInfo struct {
+	Stream uint16
+	PPID   uint32
+}
+
+// sctpConn is implemented by SCTP connections that can report the
+// stream and PPID of the most recently read message. SCTP streams are a
+// per-message property of the association, not a fixed attribute of the
+// socket, so this is queried fresh for every message rather than cached
+// once when the connection is accepted or dialed; see sctp_linux.go's
+// sctpConnWrapper, which is what actually implements this by wrapping
+// *sctp.SCTPConn.SCTPRead. This interface only names builtin types so
+// sctp.go doesn't have to import the platform-only sctp package.
+type sctpConn interface {
+	lastSCTPMessage() (stream uint16, ppid uint32, ok bool)
+}
+
+// sctpStreamSetter is implemented by sctpConn values that also let a
+// handler choose the stream their next Write goes out on, via
+// Conn.SetSCTPOutStream. Outbound PPID is always sctpPPID and doesn't
+// need to be selectable; see sctp_linux.go's sctpConnWrapper.
+type sctpStreamSetter interface {
+	setSCTPOutStream(stream uint16)
+}
+
+// sctpConnOf returns the sctpConn underlying rwc, unwrapping a *tls.Conn
+// first if present, or nil if rwc isn't backed by one. Server.Network
+// and DialTLS can combine SCTP with TLS, in which case rwc is a
+// *tls.Conn wrapping the real sctpConn rather than implementing it
+// directly.
+func sctpConnOf(rwc net.Conn) sctpConn {
+	if tlsConn, ok := rwc.(*tls.Conn); ok {
+		rwc = tlsConn.NetConn()
+	}
+	sc, _ := rwc.(sctpConn)
+	return sc
+}
+
+func isSCTPNetwork(network string) bool {
+	switch network {
+	case NetworkSCTP, NetworkSCTP4, NetworkSCTP6:
+		return true
+	default:
+		return false
+	}
+}
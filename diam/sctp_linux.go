@@ -0,0 +1,128 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package diam
+
+import (
+	"net"
+	"sync"
+
+	"github.com/ishidawataru/sctp"
+)
+
+// sctpListen opens an SCTP listener on addr, binding to localAddrs for
+// multi-homing when given.
+func sctpListen(network, addr string, localAddrs []net.IP) (net.Listener, error) {
+	laddr, err := sctp.ResolveSCTPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(localAddrs) > 0 {
+		laddr.IPAddrs = make([]net.IPAddr, len(localAddrs))
+		for i, ip := range localAddrs {
+			laddr.IPAddrs[i] = net.IPAddr{IP: ip}
+		}
+	}
+	ln, err := sctp.ListenSCTP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &sctpListener{ln}, nil
+}
+
+// sctpDial originates an SCTP association to addr.
+func sctpDial(network, addr string) (net.Conn, error) {
+	raddr, err := sctp.ResolveSCTPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := sctp.DialSCTP(network, nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return newSCTPConnWrapper(c), nil
+}
+
+// sctpListener wraps sctp.SCTPListener so every net.Conn it accepts is
+// wrapped for per-message stream/PPID tracking, same as sctpDial.
+type sctpListener struct {
+	*sctp.SCTPListener
+}
+
+func (l *sctpListener) Accept() (net.Conn, error) {
+	c, err := l.SCTPListener.AcceptSCTP()
+	if err != nil {
+		return nil, err
+	}
+	return newSCTPConnWrapper(c), nil
+}
+
+// sctpConnWrapper wraps *sctp.SCTPConn so Read goes through SCTPRead,
+// recording the stream and PPID of the message each raw read delivered.
+// The underlying package does not expose a fixed per-connection stream
+// accessor: SCTP streams are a per-message property of the association,
+// reported only via SCTPRead's SndRcvInfo, so that's what this caches
+// for lastSCTPMessage (the sctpConn interface declared in sctp.go) to
+// return. It is updated on every read, not just once at accept/dial
+// time.
+type sctpConnWrapper struct {
+	*sctp.SCTPConn
+
+	mu        sync.Mutex
+	stream    uint16 // stream the last message was read on
+	ppid      uint32
+	have      bool
+	outStream uint16 // stream the next Write goes out on; set via setSCTPOutStream
+}
+
+func newSCTPConnWrapper(c *sctp.SCTPConn) *sctpConnWrapper {
+	return &sctpConnWrapper{SCTPConn: c}
+}
+
+// Read implements net.Conn via SCTPRead, so every read updates the
+// stream/PPID lastSCTPMessage reports.
+func (c *sctpConnWrapper) Read(b []byte) (int, error) {
+	n, info, err := c.SCTPConn.SCTPRead(b)
+	if info != nil {
+		c.mu.Lock()
+		c.stream = info.Stream
+		c.ppid = info.PPID
+		c.have = true
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// lastSCTPMessage implements the sctpConn interface declared in sctp.go.
+func (c *sctpConnWrapper) lastSCTPMessage() (stream uint16, ppid uint32, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stream, c.ppid, c.have
+}
+
+// Write implements net.Conn via SCTPWrite, setting PPID 46 and the
+// SCTP_UNORDERED flag on every outbound chunk as RFC 6733 section 2.1.1
+// requires for Diameter over SCTP, and the stream last selected via
+// setSCTPOutStream (stream 0 until a handler picks one).
+func (c *sctpConnWrapper) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	stream := c.outStream
+	c.mu.Unlock()
+	return c.SCTPConn.SCTPWrite(b, &sctp.SndRcvInfo{
+		Stream: stream,
+		PPID:   sctpPPID,
+		Flags:  sctp.SCTP_UNORDERED,
+	})
+}
+
+// setSCTPOutStream implements the sctpStreamSetter interface declared
+// in sctp.go, letting a handler pick the stream for its next Write.
+func (c *sctpConnWrapper) setSCTPOutStream(stream uint16) {
+	c.mu.Lock()
+	c.outStream = stream
+	c.mu.Unlock()
+}
@@ -0,0 +1,25 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package diam
+
+import (
+	"fmt"
+	"net"
+)
+
+// sctpListen and sctpDial require kernel SCTP support that is only wired
+// up for linux; other platforms report an error instead of failing to
+// build.
+
+func sctpListen(network, addr string, localAddrs []net.IP) (net.Listener, error) {
+	return nil, fmt.Errorf("diam: %s transport is not supported on this platform", network)
+}
+
+func sctpDial(network, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("diam: %s transport is not supported on this platform", network)
+}
@@ -0,0 +1,57 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package diam
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// fakeSCTPConn wraps a net.Conn and implements sctpConn, standing in for
+// sctp_linux.go's sctpConnWrapper without needing real SCTP kernel
+// support.
+type fakeSCTPConn struct {
+	net.Conn
+}
+
+func (f *fakeSCTPConn) lastSCTPMessage() (stream uint16, ppid uint32, ok bool) {
+	return 7, sctpPPID, true
+}
+
+// TestSCTPConnOf is a regression test for a bug found in review:
+// sctpConnOf (called by newConn) must unwrap a *tls.Conn to find the
+// sctpConn underneath, since Server.Network combined with
+// ListenAndServeTLS or DialTLS hands newConn a *tls.Conn wrapping the
+// real connection rather than one implementing sctpConn directly.
+func TestSCTPConnOf(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	fc := &fakeSCTPConn{Conn: server}
+
+	t.Run("plain sctpConn", func(t *testing.T) {
+		if got := sctpConnOf(fc); got != sctpConn(fc) {
+			t.Fatalf("sctpConnOf(fc) = %v, want fc", got)
+		}
+	})
+
+	t.Run("sctpConn wrapped in tls.Conn", func(t *testing.T) {
+		tlsConn := tls.Client(fc, &tls.Config{InsecureSkipVerify: true})
+		if got := sctpConnOf(tlsConn); got != sctpConn(fc) {
+			t.Fatalf("sctpConnOf(tlsConn) = %v, want the wrapped fc", got)
+		}
+	})
+
+	t.Run("neither sctp nor tls", func(t *testing.T) {
+		plainClient, plainServer := net.Pipe()
+		defer plainClient.Close()
+		defer plainServer.Close()
+		if got := sctpConnOf(plainServer); got != nil {
+			t.Fatalf("sctpConnOf(plainServer) = %v, want nil", got)
+		}
+	})
+}
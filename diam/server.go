@@ -10,11 +10,13 @@ import (
 	"bufio"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -22,6 +24,24 @@ import (
 	"github.com/fiorix/go-diameter/diam/dict"
 )
 
+// ErrServerClosed is returned by Server.Serve and Server.ListenAndServe*
+// after a call to Shutdown.
+var ErrServerClosed = errors.New("diam: Server closed")
+
+// shutdownPollInterval is how often Shutdown polls for live connections
+// to finish while waiting for the context to be done.
+var shutdownPollInterval = 500 * time.Millisecond
+
+// shutdownReadTimeout is the read deadline Shutdown sets on a conn's
+// underlying connection to unblock a read that is currently in flight.
+const shutdownReadTimeout = 10 * time.Millisecond
+
+// shutdownDefaultGrace is the grace window Shutdown waits, after
+// notifying connections via StateShuttingDown, before it forces the
+// shutdownReadTimeout deadline that cuts off an in-flight read. It is
+// used when Server.ShutdownGrace is zero.
+const shutdownDefaultGrace = 5 * time.Second
+
 // The Handler interface allow arbitrary objects to be
 // registered to serve particular messages like CER, DWR.
 //
@@ -41,6 +61,8 @@ type Conn interface {
 	TLS() *tls.ConnectionState      // TLS or nil when not using TLS
 	Context() context.Context       // Returns the internal context
 	SetContext(ctx context.Context) // Stores a new context
+	SCTPInfo() (SCTPInfo, bool)     // SCTP stream/PPID info, or ok=false when not using SCTP
+	SetSCTPOutStream(stream uint16) // Selects the SCTP stream for the next Write; no-op when not using SCTP
 }
 
 // The CloseNotifier interface is implemented by Conns which
@@ -53,6 +75,83 @@ type CloseNotifier interface {
 	CloseNotify() <-chan struct{}
 }
 
+// ConnState represents the state of a connection served by a Server,
+// reported to an optional Server.ConnState callback.
+type ConnState int
+
+const (
+	// StateNew represents a new connection that has not yet read a
+	// message. It transitions to StateActive, StateShuttingDown or
+	// StateClosed.
+	StateNew ConnState = iota
+
+	// StateActive represents a connection that has read a message and
+	// is currently running its handler. It transitions to StateIdle
+	// once the handler returns, to StateHijacked if the handler
+	// hijacked it, and to StateShuttingDown or StateClosed.
+	StateActive
+
+	// StateIdle represents a connection that has finished handling a
+	// message and is waiting to read the next one. It transitions to
+	// StateActive, StateShuttingDown or StateClosed.
+	StateIdle
+
+	// StateShuttingDown represents a connection whose Server has had
+	// Shutdown called on it. It is reported once for each connection
+	// live when Shutdown is called, from a goroutine Shutdown starts for
+	// that connection just before the Server.ShutdownGrace window
+	// begins; Shutdown does not wait for the hook to return. Until the
+	// grace window elapses and the connection's blocking read is
+	// forcibly unblocked, a ConnState hook observing this state still
+	// has a live, writable Conn and can use it to send a
+	// Disconnect-Peer-Request (or other orderly teardown message) before
+	// the socket goes away. It transitions to StateActive, StateIdle,
+	// StateClosed or StateHijacked.
+	StateShuttingDown
+
+	// StateClosed represents a closed connection. It is a terminal
+	// state, reached from any of the above.
+	StateClosed
+
+	// StateHijacked represents a connection taken over via the
+	// Hijacker interface. Like StateClosed it is terminal and the
+	// connection stops being tracked by the Server, but unlike
+	// StateClosed the underlying net.Conn is left open; the caller
+	// that hijacked it owns its lifecycle from this point on.
+	StateHijacked
+)
+
+var connStateName = map[ConnState]string{
+	StateNew:          "new",
+	StateActive:       "active",
+	StateIdle:         "idle",
+	StateShuttingDown: "shutting down",
+	StateClosed:       "closed",
+	StateHijacked:     "hijacked",
+}
+
+// String returns the name of the connection state.
+func (s ConnState) String() string {
+	return connStateName[s]
+}
+
+// Hijacker is implemented by Conns that let a handler take over the
+// underlying network connection and manage framing itself, e.g. to
+// tunnel another protocol over an established connection. After Hijack
+// is called the server stops reading messages from and writing messages
+// to the connection.
+type Hijacker interface {
+	// Hijack returns the underlying connection and its buffered
+	// reader/writer. The caller becomes responsible for closing the
+	// connection.
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
+}
+
+// ErrAbortHandler is a sentinel panic value recognized by conn.serve: a
+// handler that panics with ErrAbortHandler closes the connection without
+// the stack dump normally logged for a panicking handler.
+var ErrAbortHandler = errors.New("diam: abort handler")
+
 // A liveSwitchReader is a switchReader that's safe for concurrent
 // reads and switches, if its mutex is held.
 type liveSwitchReader struct {
@@ -74,11 +173,74 @@ type conn struct {
 	sr       liveSwitchReader     // reads from rwc
 	buf      *bufio.ReadWriter    // buffered(sr, rwc)
 	tlsState *tls.ConnectionState // or nil when not using TLS
+	sctpConn sctpConn             // or nil when not using SCTP; queried per message
 	writer   *response            // the diam.Conn exposed to handlers
 
 	mu           sync.Mutex // guards the following
 	closeNotifyc chan struct{}
 	clientGone   bool
+	closing      bool // true once Shutdown has signaled this conn to stop
+
+	hijacked bool // true once response.Hijack has been called; guarded by writer.mu, not mu above
+}
+
+// isHijacked reports whether the connection has been taken over via
+// response.Hijack.
+func (c *conn) isHijacked() bool {
+	c.writer.mu.Lock()
+	defer c.writer.mu.Unlock()
+	return c.hijacked
+}
+
+// notifyShuttingDown reports, via setState, that c's Server is shutting
+// down. Server.Shutdown runs it in its own goroutine, before the grace
+// window in forceStop, so a ConnState hook gets a chance to write a
+// Disconnect-Peer-Request over the still-open connection without a slow
+// or unresponsive peer blocking Shutdown itself.
+func (c *conn) notifyShuttingDown() {
+	c.setState(StateShuttingDown)
+}
+
+// stop marks the connection for shutdown and sets a short read and
+// write deadline to unblock a read or write that may currently be in
+// flight, including a ConnState hook's blocking Write of a DPR from
+// notifyShuttingDown.
+func (c *conn) stop() {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	deadline := time.Now().Add(shutdownReadTimeout)
+	c.rwc.SetReadDeadline(deadline)
+	c.rwc.SetWriteDeadline(deadline)
+}
+
+// shouldStop reports whether the connection has been asked to stop
+// serving new messages, typically by Server.Shutdown.
+func (c *conn) shouldStop() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+// setState notifies the Server that c has transitioned to state,
+// updating the Server's live-connection tracking and, if set, invoking
+// Server.ConnState. StateShuttingDown leaves the tracking as it is, so
+// a notification that lands after the connection closed or was
+// hijacked does not put it back into srv.conns.
+func (c *conn) setState(state ConnState) {
+	srv := c.server
+	if state != StateShuttingDown {
+		srv.trackConn(c, state != StateClosed && state != StateHijacked)
+	}
+	switch state {
+	case StateNew:
+		recordConnDelta(srv, 1)
+	case StateClosed, StateHijacked:
+		recordConnDelta(srv, -1)
+	}
+	if hook := srv.ConnState; hook != nil {
+		hook(c.writer, state)
+	}
 }
 
 func (c *conn) closeNotify() <-chan struct{} {
@@ -121,6 +283,7 @@ func (srv *Server) newConn(rwc net.Conn) (c *conn, err error) {
 	}
 	c.buf = bufio.NewReadWriter(bufio.NewReader(&c.sr), bufio.NewWriter(rwc))
 	c.writer = &response{conn: c}
+	c.sctpConn = sctpConnOf(rwc)
 	return c, nil
 }
 
@@ -137,20 +300,30 @@ func (c *conn) readMessage() (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	recordBytesRead(int(m.Header.MessageLength()))
 	return m, nil
 }
 
 // Serve a new connection.
 func (c *conn) serve() {
 	defer func() {
-		if err := recover(); err != nil {
+		if err := recover(); err != nil && err != ErrAbortHandler {
 			buf := make([]byte, 4096)
 			buf = buf[:runtime.Stack(buf, false)]
 			log.Printf("DIAM: panic serving %v: %v\n%s",
 				c.rwc.RemoteAddr().String(), err, buf)
 		}
-		c.rwc.Close()
+		if c.isHijacked() {
+			// The caller owns rwc now; just stop tracking the
+			// connection so it doesn't leak into srv.conns or the
+			// active_conns gauge.
+			c.setState(StateHijacked)
+		} else {
+			c.rwc.Close()
+			c.setState(StateClosed)
+		}
 	}()
+	c.setState(StateNew)
 	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
 		if err := tlsConn.Handshake(); err != nil {
 			return
@@ -159,11 +332,15 @@ func (c *conn) serve() {
 		*c.tlsState = tlsConn.ConnectionState()
 	}
 	for {
+		if c.shouldStop() {
+			return
+		}
 		m, err := c.readMessage()
 		if err != nil {
 			c.rwc.Close()
 			// Report errors to the channel, except EOF.
 			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				recordError(c.server, "read")
 				h := c.server.Handler
 				if h == nil {
 					h = DefaultServeMux
@@ -175,7 +352,12 @@ func (c *conn) serve() {
 			break
 		}
 		// Handle messages in this goroutine.
+		c.setState(StateActive)
 		serverHandler{c.server}.ServeDIAM(c.writer, m)
+		if c.isHijacked() {
+			return
+		}
+		c.setState(StateIdle)
 	}
 }
 
@@ -201,6 +383,7 @@ func (w *response) Write(b []byte) (int, error) {
 	if err = w.conn.buf.Writer.Flush(); err != nil {
 		return 0, err
 	}
+	recordBytesWritten(n)
 	return n, nil
 }
 
@@ -229,6 +412,48 @@ func (w *response) CloseNotify() <-chan struct{} {
 	return w.conn.closeNotify()
 }
 
+// SCTPInfo returns the SCTP stream and PPID of the message currently
+// being handled, or ok=false when the connection is not SCTP. Streams
+// are a per-message property of the association, so this is queried
+// fresh on every call rather than fixed for the lifetime of the Conn.
+func (w *response) SCTPInfo() (SCTPInfo, bool) {
+	if w.conn.sctpConn == nil {
+		return SCTPInfo{}, false
+	}
+	stream, ppid, ok := w.conn.sctpConn.lastSCTPMessage()
+	if !ok {
+		return SCTPInfo{}, false
+	}
+	return SCTPInfo{Stream: stream, PPID: ppid}, true
+}
+
+// SetSCTPOutStream selects the SCTP stream the next Write goes out on.
+// It is a no-op when the connection is not using SCTP or the underlying
+// sctpConn doesn't support stream selection.
+func (w *response) SetSCTPOutStream(stream uint16) {
+	if s, ok := w.conn.sctpConn.(sctpStreamSetter); ok {
+		s.setSCTPOutStream(stream)
+	}
+}
+
+// Hijack implements the Hijacker interface.
+func (w *response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn.hijacked {
+		return nil, nil, errors.New("diam: connection has already been hijacked")
+	}
+	w.conn.hijacked = true
+	// Untrack the connection synchronously, here, instead of waiting for
+	// conn.serve's post-ServeDIAM defer to notice isHijacked and call
+	// setState(StateHijacked): otherwise a Shutdown landing in the
+	// window between this call returning and ServeDIAM returning would
+	// still see the conn in srv.conns and have forceStop set a deadline
+	// on the net.Conn the caller now owns.
+	w.conn.server.trackConn(w.conn, false)
+	return w.conn.rwc, w.conn.buf, nil
+}
+
 // Context returns the internal context or a new context.Background.
 func (w *response) Context() context.Context {
 	w.mu.Lock()
@@ -345,6 +570,7 @@ func (mux *ServeMux) serve(cmd string, c Conn, m *Message) {
 		entry.h.ServeDIAM(c, m)
 		return
 	}
+	expUnhandled.Add(1)
 	mux.Error(ErrorReport{
 		Conn:    c,
 		Message: m,
@@ -403,6 +629,175 @@ type Server struct {
 	ReadTimeout  time.Duration // maximum duration before timing out read of the request
 	WriteTimeout time.Duration // maximum duration before timing out write of the response
 	TLSConfig    *tls.Config   // optional TLS config, used by ListenAndServeTLS
+
+	// Network is the transport to listen on: "tcp" (the default),
+	// "sctp", "sctp4" or "sctp6". SCTP requires kernel support and a
+	// platform build of this package that provides it (linux only, as
+	// of this writing).
+	Network string
+
+	// LocalAddrs lists the local IP addresses to bind when Network is
+	// one of the SCTP values, enabling SCTP multi-homing. Ignored for
+	// "tcp".
+	LocalAddrs []net.IP
+
+	// ConnState, if non-nil, is called whenever a connection changes
+	// state. See the ConnState constants for details.
+	ConnState func(Conn, ConnState)
+
+	// ShutdownGrace is how long Shutdown waits, after reporting
+	// StateShuttingDown on every live connection, before it forcibly
+	// unblocks any read still in flight. Zero means shutdownDefaultGrace.
+	ShutdownGrace time.Duration
+
+	// CertProvider, if non-nil, supplies certificates for
+	// ListenAndServeTLS dynamically instead of the fixed certFile and
+	// keyFile, enabling hot-reload and SNI-based certificate selection.
+	CertProvider CertProvider
+
+	// TLSNextPeer, if non-nil, is called with the ClientHelloInfo of
+	// every incoming TLS handshake before CertProvider selects a
+	// certificate, so operators can log which realm requested which
+	// cert. Only consulted when CertProvider is set.
+	TLSNextPeer func(*tls.ClientHelloInfo)
+
+	// Stats, if non-nil, receives connection and message events in
+	// addition to the counters the Server always publishes under
+	// expvar.NewMap("diam").
+	Stats Stats
+
+	inShutdown int32 // accessed atomically; true once Shutdown has been called
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+}
+
+// trackListener adds or removes ln from the set of listeners srv is
+// currently accepting connections on.
+func (srv *Server) trackListener(ln net.Listener, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[ln] = struct{}{}
+	} else {
+		delete(srv.listeners, ln)
+	}
+}
+
+// trackConn adds or removes c from the set of live connections srv is
+// currently serving.
+func (srv *Server) trackConn(c *conn, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.conns == nil {
+			srv.conns = make(map[*conn]struct{})
+		}
+		srv.conns[c] = struct{}{}
+	} else {
+		delete(srv.conns, c)
+	}
+}
+
+// numConns returns the number of connections srv is currently serving.
+func (srv *Server) numConns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+// shuttingDown reports whether Shutdown has been called on srv.
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// ShuttingDown reports whether Shutdown has been called on srv. Handlers
+// can poll it to decide whether to keep accepting new work, in addition
+// to watching for StateShuttingDown on Server.ConnState.
+func (srv *Server) ShuttingDown() bool {
+	return srv.shuttingDown()
+}
+
+// Shutdown closes all of srv's listeners and reports StateShuttingDown
+// on every live connection, so a ConnState hook can send a
+// Disconnect-Peer-Request (or other orderly teardown message) over the
+// still-open socket. After Server.ShutdownGrace (or shutdownDefaultGrace
+// if unset) has passed, Shutdown forcibly unblocks any read or write
+// still in flight, including a ConnState hook's own DPR write, so the
+// connection can close. It waits for every connection to
+// finish, or for ctx to be done, whichever happens first; if ctx is done
+// first, Shutdown sets the same short read and write deadline on any
+// remaining connections and returns ctx.Err() without waiting for them
+// to close.
+//
+// Once Shutdown has been called, srv may not be reused; Serve and the
+// ListenAndServe methods return ErrServerClosed.
+//
+// Shutdown makes no attempt to close or wait for connections taken over
+// via Hijack: a hijacked connection stops being tracked the moment it is
+// hijacked, so Shutdown neither blocks on it nor closes its net.Conn.
+// Callers that hijack connections are responsible for their lifecycle,
+// including during shutdown.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	conns := make([]*conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mu.Unlock()
+
+	// notifyShuttingDown runs the user's ConnState hook, which may do a
+	// blocking Conn.Write (e.g. a DPR) with no deadline of its own. Fan
+	// it out to a goroutine per connection instead of calling it inline
+	// here, so a hook stuck on one unresponsive peer can't stop this
+	// function from ever reaching the ctx/grace-aware loop below; that
+	// loop's forceStop still reaches the stuck connection by deadline.
+	for _, c := range conns {
+		go c.notifyShuttingDown()
+	}
+
+	grace := srv.ShutdownGrace
+	if grace == 0 {
+		grace = shutdownDefaultGrace
+	}
+	graceTimer := time.NewTimer(grace)
+	defer graceTimer.Stop()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.numConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			srv.forceStop()
+			return ctx.Err()
+		case <-graceTimer.C:
+			srv.forceStop()
+		case <-ticker.C:
+		}
+	}
+}
+
+// forceStop sets a short read and write deadline on every remaining
+// live connection, unblocking any read or write in flight so conn.serve
+// observes shouldStop and exits.
+func (srv *Server) forceStop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		c.stop()
+	}
 }
 
 // serverHandler delegates to either the server's Handler or DefaultServeMux.
@@ -415,7 +810,11 @@ func (sh serverHandler) ServeDIAM(w Conn, m *Message) {
 	if handler == nil {
 		handler = DefaultServeMux
 	}
+	start := time.Now()
 	handler.ServeDIAM(w, m)
+	isRequest := m.Header.CommandFlags&RequestFlag == RequestFlag
+	recordMessage(sh.srv, m.Header.ApplicationID, m.Header.CommandCode,
+		isRequest, time.Since(start), int(m.Header.MessageLength()))
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
@@ -426,22 +825,42 @@ func (srv *Server) ListenAndServe() error {
 	if len(addr) == 0 {
 		addr = ":3868"
 	}
-	l, e := net.Listen("tcp", addr)
+	l, e := srv.listen(addr)
 	if e != nil {
 		return e
 	}
 	return srv.Serve(l)
 }
 
+// listen opens a listener for srv.Network (tcp, if empty) on addr.
+func (srv *Server) listen(addr string) (net.Listener, error) {
+	switch {
+	case srv.Network == "" || srv.Network == NetworkTCP:
+		return net.Listen("tcp", addr)
+	case isSCTPNetwork(srv.Network):
+		return sctpListen(srv.Network, addr, srv.LocalAddrs)
+	default:
+		return nil, fmt.Errorf("diam: unsupported network %q", srv.Network)
+	}
+}
+
 // Serve accepts incoming connections on the Listener l, creating a
 // new service goroutine for each.  The service goroutines read requests and
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
 	defer l.Close()
+	srv.trackListener(l, true)
+	defer srv.trackListener(l, false)
 	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		rw, e := l.Accept()
 		if e != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -458,6 +877,7 @@ func (srv *Server) Serve(l net.Listener) error {
 			return e
 		}
 		tempDelay = 0
+		recordAccept()
 		if c, err := srv.newConn(rw); err != nil {
 			continue
 		} else {
@@ -496,13 +916,22 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if srv.TLSConfig != nil {
 		*config = *srv.TLSConfig
 	}
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+	if srv.CertProvider != nil {
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if srv.TLSNextPeer != nil {
+				srv.TLSNextPeer(hello)
+			}
+			return srv.CertProvider.GetCertificate(hello)
+		}
+	} else {
+		var err error
+		config.Certificates = make([]tls.Certificate, 1)
+		config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
 	}
-	conn, err := net.Listen("tcp", addr)
+	conn, err := srv.listen(addr)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,88 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package diam
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// waitFor polls cond every 5ms until it reports true or the deadline
+// passes, failing the test in the latter case. Used instead of a fixed
+// sleep so the test isn't flaky under load but still bounded.
+func waitFor(t *testing.T, deadline time.Duration, msg string, cond func() bool) {
+	t.Helper()
+	end := time.Now().Add(deadline)
+	for !cond() {
+		if time.Now().After(end) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestServerShutdown is a regression test for connections that were
+// never untracked, which would make Shutdown poll srv.numConns until its
+// ctx deadline. It also checks that the ConnState hook observes
+// StateShuttingDown and that Serve returns ErrServerClosed. Its hook
+// never blocks, so it does not exercise a stuck hook.
+func TestServerShutdown(t *testing.T) {
+	orig := shutdownPollInterval
+	shutdownPollInterval = 5 * time.Millisecond
+	defer func() { shutdownPollInterval = orig }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{ShutdownGrace: 20 * time.Millisecond}
+	var mu sync.Mutex
+	var sawShuttingDown bool
+	srv.ConnState = func(c Conn, s ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		if s == StateShuttingDown {
+			sawShuttingDown = true
+		}
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	waitFor(t, time.Second, "server never registered the dialed connection",
+		func() bool { return srv.numConns() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v, want nil", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !sawShuttingDown {
+		t.Fatal("ConnState never observed StateShuttingDown")
+	}
+
+	select {
+	case err := <-serveErr:
+		if err != ErrServerClosed {
+			t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Shutdown closed its listener")
+	}
+}
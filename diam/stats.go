@@ -0,0 +1,199 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Built-in expvar instrumentation and the pluggable Stats interface.
+
+package diam
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stats receives server events for metrics collection, letting
+// operators route the same events a Server publishes under expvar to
+// Prometheus, OpenTelemetry or anything else. All methods must be safe
+// for concurrent use. A nil Server.Stats disables these calls entirely;
+// the expvar counters below are always maintained regardless.
+type Stats interface {
+	// IncConn adjusts the active connection count by delta.
+	IncConn(delta int)
+
+	// ObserveMessage records one message processed by a handler,
+	// including the time spent running it.
+	ObserveMessage(appID, cmdCode uint32, isRequest bool, latency time.Duration, bytes int)
+
+	// IncError records one error, tagged by kind. The Server reports
+	// errors reading or parsing a message off a connection as kind
+	// "read"; messages no handler is registered for are counted only
+	// under expvar ("unhandled_messages") and are not reported here.
+	IncError(kind string)
+}
+
+var (
+	expvarMap        = expvar.NewMap("diam")
+	expAcceptedConns = new(expvar.Int)
+	expActiveConns   = new(expvar.Int)
+	expBytesRead     = new(expvar.Int)
+	expBytesWritten  = new(expvar.Int)
+	expUnhandled     = new(expvar.Int)
+	expErrors        = new(expvar.Map)
+	expMessages      = new(expvar.Map) // keyed by "appID/cmdCode/R" or "...A"
+
+	expMu      sync.Mutex
+	expLatency = map[string]*latencyHistogram{} // per-command handler latency, guarded by expMu
+)
+
+// latencyBucketsNS are the upper bounds, in nanoseconds, of the
+// cumulative latency buckets kept by latencyHistogram. They run from
+// sub-millisecond to multi-second, which covers everything from a
+// local handler doing no I/O to one blocking on a slow upstream.
+var latencyBucketsNS = []int64{
+	(1 * time.Millisecond).Nanoseconds(),
+	(5 * time.Millisecond).Nanoseconds(),
+	(10 * time.Millisecond).Nanoseconds(),
+	(50 * time.Millisecond).Nanoseconds(),
+	(100 * time.Millisecond).Nanoseconds(),
+	(500 * time.Millisecond).Nanoseconds(),
+	(1 * time.Second).Nanoseconds(),
+	(5 * time.Second).Nanoseconds(),
+}
+
+// latencyHistogram is a fixed-bucket, Prometheus-style cumulative
+// histogram of handler latencies for one command: bucket i counts every
+// observation less than or equal to latencyBucketsNS[i], except the last
+// bucket, which also counts observations above the highest bound and so
+// always equals the overall count (the implicit "+Inf" bucket). String
+// still labels that bucket with the highest bound.
+// It also keeps a running sum and count so callers can derive a mean
+// without querying every bucket. It implements expvar.Var via String.
+type latencyHistogram struct {
+	buckets []expvar.Int
+	sum     expvar.Int
+	count   expvar.Int
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]expvar.Int, len(latencyBucketsNS))}
+}
+
+// observe records one latency sample.
+func (h *latencyHistogram) observe(d time.Duration) {
+	ns := d.Nanoseconds()
+	last := len(latencyBucketsNS) - 1
+	for i, bound := range latencyBucketsNS {
+		// The last bucket is the implicit +Inf bucket: it counts
+		// every observation, including those past the highest
+		// explicit bound, so its count always equals h.count.
+		if ns <= bound || i == last {
+			h.buckets[i].Add(1)
+		}
+	}
+	h.sum.Add(ns)
+	h.count.Add(1)
+}
+
+// String implements expvar.Var.
+func (h *latencyHistogram) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `{"count":%s,"sum_ns":%s,"buckets":{`, h.count.String(), h.sum.String())
+	for i, bound := range latencyBucketsNS {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `"le_%dns":%s`, bound, h.buckets[i].String())
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+func init() {
+	expvarMap.Set("accepted_conns", expAcceptedConns)
+	expvarMap.Set("active_conns", expActiveConns)
+	expvarMap.Set("bytes_read", expBytesRead)
+	expvarMap.Set("bytes_written", expBytesWritten)
+	expvarMap.Set("unhandled_messages", expUnhandled)
+	expErrors.Init()
+	expvarMap.Set("errors", expErrors)
+	expMessages.Init()
+	expvarMap.Set("messages", expMessages)
+}
+
+// recordAccept records a newly accepted connection.
+func recordAccept() {
+	expAcceptedConns.Add(1)
+}
+
+// recordConnDelta adjusts the active connection gauge and forwards the
+// event to srv.Stats, if set.
+func recordConnDelta(srv *Server, delta int) {
+	expActiveConns.Add(int64(delta))
+	if srv.Stats != nil {
+		srv.Stats.IncConn(delta)
+	}
+}
+
+// maxMessageKeys bounds the number of distinct "appID/cmdCode/dir" keys
+// tracked individually under expvar. ApplicationID and CommandCode come
+// straight off the wire header and ReadMessage only requires a
+// well-formed AVP stream, not a dictionary-recognized command (see
+// ServeMux.ServeDIAM's "ALL" catch-all), so without a cap a peer that
+// never even authenticates could mint an unbounded number of expvar
+// entries and latencyHistograms that are never evicted. Once the cap is
+// reached, further distinct keys are lumped into "other" instead.
+const maxMessageKeys = 256
+
+// recordMessage records one processed message's direction, size and
+// handler latency, both under expvar and, if set, to srv.Stats.
+func recordMessage(srv *Server, appID, cmdCode uint32, isRequest bool, latency time.Duration, bytes int) {
+	dir := "A"
+	if isRequest {
+		dir = "R"
+	}
+	key := fmt.Sprintf("%d/%d/%s", appID, cmdCode, dir)
+
+	expMu.Lock()
+	h, ok := expLatency[key]
+	if !ok && len(expLatency) >= maxMessageKeys {
+		key = "other"
+		h, ok = expLatency[key]
+	}
+	if !ok {
+		h = newLatencyHistogram()
+		expLatency[key] = h
+		expvarMap.Set("latency/"+key, h)
+	}
+	expMu.Unlock()
+
+	expMessages.Add(key, 1)
+	h.observe(latency)
+
+	if srv.Stats != nil {
+		srv.Stats.ObserveMessage(appID, cmdCode, isRequest, latency, bytes)
+	}
+}
+
+// recordBytesRead adds n to the bytes-read counter. It's called once
+// per message actually read off the wire, on both servers and clients.
+func recordBytesRead(n int) {
+	expBytesRead.Add(int64(n))
+}
+
+// recordBytesWritten adds n to the bytes-written counter. It's called
+// once per successful response.Write, on both servers and clients.
+func recordBytesWritten(n int) {
+	expBytesWritten.Add(int64(n))
+}
+
+// recordError records a read, parse or dispatch error tagged by kind,
+// both under expvar and, if set, to srv.Stats.
+func recordError(srv *Server, kind string) {
+	expErrors.Add(kind, 1)
+	if srv.Stats != nil {
+		srv.Stats.IncError(kind)
+	}
+}
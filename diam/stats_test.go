@@ -0,0 +1,96 @@
+// Copyright 2013-2015 go-diameter authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package diam
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLatencyHistogramObserve is a table-driven test of the bucket
+// boundaries fixed in review: each bucket counts every observation at
+// or below its bound, and the last bucket is the implicit +Inf bucket
+// that always equals the overall count.
+func TestLatencyHistogramObserve(t *testing.T) {
+	cases := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"sub-millisecond", 500 * time.Microsecond},
+		{"exactly first bound", time.Millisecond},
+		{"between two bounds", 30 * time.Millisecond},
+		{"exactly last bound", 5 * time.Second},
+		{"past every bound", 30 * time.Second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newLatencyHistogram()
+			h.observe(tc.d)
+
+			last := len(latencyBucketsNS) - 1
+			for i, bound := range latencyBucketsNS {
+				want := int64(0)
+				if tc.d.Nanoseconds() <= bound || i == last {
+					want = 1
+				}
+				if got := h.buckets[i].Value(); got != want {
+					t.Errorf("bucket[%d] (le %dns) = %d, want %d", i, bound, got, want)
+				}
+			}
+			if got := h.count.Value(); got != 1 {
+				t.Errorf("count = %d, want 1", got)
+			}
+			if got := h.sum.Value(); got != tc.d.Nanoseconds() {
+				t.Errorf("sum = %d, want %d", got, tc.d.Nanoseconds())
+			}
+		})
+	}
+}
+
+// TestLatencyHistogramObserveCumulative checks that bucket counts
+// accumulate across multiple observations rather than being overwritten.
+func TestLatencyHistogramObserveCumulative(t *testing.T) {
+	h := newLatencyHistogram()
+	h.observe(time.Millisecond) // falls in every bucket from index 0 up
+	h.observe(10 * time.Second) // only the +Inf bucket
+
+	if got := h.count.Value(); got != 2 {
+		t.Fatalf("count = %d, want 2", got)
+	}
+	last := len(latencyBucketsNS) - 1
+	if got := h.buckets[0].Value(); got != 1 {
+		t.Errorf("buckets[0] = %d, want 1 (only the 1ms sample qualifies)", got)
+	}
+	if got := h.buckets[last].Value(); got != 2 {
+		t.Errorf("buckets[last] = %d, want 2 (+Inf bucket counts everything)", got)
+	}
+}
+
+// TestRecordMessageBoundsKeySpace is a regression test for the pre-auth
+// expvar growth fixed in review: once expLatency holds maxMessageKeys
+// distinct keys, recordMessage must lump any further distinct
+// appID/cmdCode/dir combination into a shared "other" bucket instead of
+// growing the map without bound.
+func TestRecordMessageBoundsKeySpace(t *testing.T) {
+	srv := &Server{}
+	for i := 0; i < maxMessageKeys+10; i++ {
+		recordMessage(srv, uint32(900000+i), 999, true, time.Millisecond, 10)
+	}
+
+	expMu.Lock()
+	n := len(expLatency)
+	_, hasOther := expLatency["other"]
+	expMu.Unlock()
+
+	// +1 allows for the "other" bucket itself; any more means the cap
+	// didn't hold.
+	if n > maxMessageKeys+1 {
+		t.Fatalf("expLatency has %d entries after %d distinct keys, want capped near %d",
+			n, maxMessageKeys+10, maxMessageKeys)
+	}
+	if !hasOther {
+		t.Fatal(`expLatency missing the "other" overflow bucket after exceeding maxMessageKeys`)
+	}
+}